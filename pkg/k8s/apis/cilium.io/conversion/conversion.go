@@ -0,0 +1,182 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conversion implements the apiextensions.k8s.io/v1 ConversionReview
+// webhook used by multi-version Cilium CRDs (CiliumNetworkPolicy,
+// CiliumClusterwideNetworkPolicy, CiliumEndpoint, CiliumNode and
+// CiliumIdentity). The kube-apiserver calls this webhook whenever it needs to
+// present an object stored in one version to a client requesting another.
+package conversion
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cilium/cilium/pkg/k8s/apis/cilium.io/v2/client"
+	"github.com/cilium/cilium/pkg/logging"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var log = logging.DefaultLogger.WithField(logfields.LogSubsys, "k8s-crd-conversion")
+
+// converterFunc converts obj, which is known to be of the kind the converter
+// is registered for, to toVersion. obj is mutated in place and returned.
+type converterFunc func(obj *unstructured.Unstructured, toVersion string) (*unstructured.Unstructured, error)
+
+// converters holds one converterFunc per Cilium CRD kind. Once a conversion
+// webhook is configured, every Cilium CRD serves
+// client.CustomResourceDefinitionVersion and
+// client.CustomResourceDefinitionSecondVersion side by side with the same
+// schema, so identityConvert (just relabelling apiVersion) is registered for
+// all of them; a kind gets a real, schema-aware converter here once its two
+// served versions actually diverge.
+var converters = map[string]converterFunc{
+	"CiliumNetworkPolicy":            identityConvert,
+	"CiliumClusterwideNetworkPolicy": identityConvert,
+	"CiliumEndpoint":                 identityConvert,
+	"CiliumNode":                     identityConvert,
+	"CiliumIdentity":                 identityConvert,
+}
+
+// identityConvert is the converter used while a kind's served versions share
+// one schema: it just relabels apiVersion, since there is no schema
+// difference to convert. toVersion is review.Request.DesiredAPIVersion, a
+// full "group/version" string (e.g. "cilium.io/v2alpha1"), not a bare
+// version -- setting it directly as apiVersion, rather than folding it into
+// a GroupVersionKind built from obj's own group, avoids doubling the group.
+func identityConvert(obj *unstructured.Unstructured, toVersion string) (*unstructured.Unstructured, error) {
+	obj.SetAPIVersion(toVersion)
+	return obj, nil
+}
+
+// RegisterHandlers wires the ConversionReview handler into mux at
+// client.ConversionWebhookPath and records cfg as the webhook coordinates
+// client.CreateCustomResourceDefinitions embeds into every CRD's
+// spec.conversion. The operator's HTTPS server setup must call this once,
+// before the first CreateCustomResourceDefinitions call, passing the mux it
+// listens on; this package has no handle on that server itself, it only
+// exposes the handler and the registration helper.
+func RegisterHandlers(mux *http.ServeMux, cfg client.ConversionWebhookConfig) {
+	client.SetConversionWebhookConfig(cfg)
+	mux.HandleFunc(client.ConversionWebhookPath, ServeHTTP)
+}
+
+// ServeHTTP is the ConversionReview handler registered by RegisterHandlers.
+// It decodes the ConversionReview request, converts every object in
+// Request.Objects to Request.DesiredAPIVersion and writes back a
+// ConversionReview response with the same UID.
+func ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review := apiextensionsv1.ConversionReview{}
+	if err := json.Unmarshal(body, &review); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode ConversionReview: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	response := Convert(&review)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.WithError(err).Error("Unable to encode ConversionReview response")
+	}
+}
+
+// Convert runs the conversion described by review.Request and returns a
+// ConversionReview carrying the response. It never returns nil and never
+// panics on a malformed request; malformed input is reported via
+// Response.Result instead.
+func Convert(review *apiextensionsv1.ConversionReview) *apiextensionsv1.ConversionReview {
+	resp := &apiextensionsv1.ConversionReview{
+		TypeMeta: review.TypeMeta,
+		Response: &apiextensionsv1.ConversionResponse{
+			Result: metav1.Status{Status: metav1.StatusSuccess},
+		},
+	}
+
+	if review.Request == nil {
+		resp.Response.Result = failureStatus("ConversionReview.request is nil")
+		return resp
+	}
+
+	resp.Response.UID = review.Request.UID
+
+	converted := make([]runtime.RawExtension, 0, len(review.Request.Objects))
+	for _, raw := range review.Request.Objects {
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(raw.Raw); err != nil {
+			resp.Response.Result = failureStatus(fmt.Sprintf("unable to decode object to convert: %s", err))
+			resp.Response.ConvertedObjects = nil
+			return resp
+		}
+
+		converter, ok := converters[obj.GetKind()]
+		if !ok {
+			resp.Response.Result = failureStatus(fmt.Sprintf("no converter registered for kind %q", obj.GetKind()))
+			resp.Response.ConvertedObjects = nil
+			return resp
+		}
+
+		convertedObj, err := converter(obj, review.Request.DesiredAPIVersion)
+		if err != nil {
+			resp.Response.Result = failureStatus(fmt.Sprintf("unable to convert %s/%s: %s", obj.GetKind(), obj.GetName(), err))
+			resp.Response.ConvertedObjects = nil
+			return resp
+		}
+
+		// UID and ResourceVersion are immutable identity fields; the
+		// apiserver rejects a ConversionResponse that changes them.
+		convertedObj.SetUID(obj.GetUID())
+		convertedObj.SetResourceVersion(obj.GetResourceVersion())
+
+		encoded, err := convertedObj.MarshalJSON()
+		if err != nil {
+			resp.Response.Result = failureStatus(fmt.Sprintf("unable to encode converted %s/%s: %s", obj.GetKind(), obj.GetName(), err))
+			resp.Response.ConvertedObjects = nil
+			return resp
+		}
+		converted = append(converted, runtime.RawExtension{Raw: encoded})
+	}
+
+	resp.Response.ConvertedObjects = converted
+	return resp
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read request body: %w", err)
+	}
+	return body, nil
+}
+
+func failureStatus(msg string) metav1.Status {
+	log.WithField("reason", msg).Error("CRD conversion failed")
+	return metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: msg,
+	}
+}
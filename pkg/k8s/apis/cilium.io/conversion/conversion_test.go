@@ -0,0 +1,102 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conversion
+
+import (
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// TestIdentityConvertSetsFullAPIVersion guards against toVersion (a full
+// "group/version" string) being folded into a GroupVersionKind built from
+// obj's own group, which doubles the group instead of replacing it.
+func TestIdentityConvertSetsFullAPIVersion(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("cilium.io/v2")
+	obj.SetKind("CiliumNetworkPolicy")
+
+	converted, err := identityConvert(obj, "cilium.io/v2alpha1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if got, want := converted.GetAPIVersion(), "cilium.io/v2alpha1"; got != want {
+		t.Fatalf("apiVersion = %q, want %q", got, want)
+	}
+	if got, want := converted.GetKind(), "CiliumNetworkPolicy"; got != want {
+		t.Fatalf("kind = %q, want %q", got, want)
+	}
+}
+
+// TestConvertRoundTrips exercises Convert, the part of ServeHTTP after the
+// request is decoded: build a ConversionReview requesting a CiliumNetworkPolicy
+// be converted to v2alpha1, and check the response carries the object with
+// the desired apiVersion, the original UID/ResourceVersion, and the same UID
+// on the response itself.
+func TestConvertRoundTrips(t *testing.T) {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("cilium.io/v2")
+	obj.SetKind("CiliumNetworkPolicy")
+	obj.SetName("my-policy")
+	obj.SetUID("abc-123")
+	obj.SetResourceVersion("42")
+
+	raw, err := obj.MarshalJSON()
+	if err != nil {
+		t.Fatalf("unexpected error marshalling object: %s", err)
+	}
+
+	review := &apiextensionsv1.ConversionReview{
+		Request: &apiextensionsv1.ConversionRequest{
+			UID:               "review-uid",
+			DesiredAPIVersion: "cilium.io/v2alpha1",
+			Objects:           []runtime.RawExtension{{Raw: raw}},
+		},
+	}
+
+	resp := Convert(review)
+
+	if resp.Response == nil {
+		t.Fatal("expected a non-nil Response")
+	}
+	if resp.Response.Result.Status != metav1.StatusSuccess {
+		t.Fatalf("expected success, got: %+v", resp.Response.Result)
+	}
+	if resp.Response.UID != review.Request.UID {
+		t.Fatalf("response UID = %q, want %q", resp.Response.UID, review.Request.UID)
+	}
+	if len(resp.Response.ConvertedObjects) != 1 {
+		t.Fatalf("expected 1 converted object, got %d", len(resp.Response.ConvertedObjects))
+	}
+
+	converted := &unstructured.Unstructured{}
+	if err := converted.UnmarshalJSON(resp.Response.ConvertedObjects[0].Raw); err != nil {
+		t.Fatalf("unexpected error unmarshalling converted object: %s", err)
+	}
+
+	if got, want := converted.GetAPIVersion(), "cilium.io/v2alpha1"; got != want {
+		t.Fatalf("converted apiVersion = %q, want %q", got, want)
+	}
+	if got, want := converted.GetUID(), obj.GetUID(); got != want {
+		t.Fatalf("converted UID = %q, want %q", got, want)
+	}
+	if got, want := converted.GetResourceVersion(), obj.GetResourceVersion(); got != want {
+		t.Fatalf("converted ResourceVersion = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+// fieldDeprecation describes a single CNP/CCNP/CEP/CiliumNode/CiliumIdentity
+// field that is on its way out of the schema. sinceVersion/removedInVersion
+// are CustomResourceDefinitionSchemaVersion-comparable strings and are only
+// used for the human-readable message; nothing enforces them automatically.
+type fieldDeprecation struct {
+	kind             string
+	jsonPath         string
+	sinceVersion     string
+	removedInVersion string
+	message          string
+}
+
+// deprecatedFields is the table of known-deprecated paths across all Cilium
+// CRD kinds. Add an entry here whenever a field is slated for removal in a
+// future schema version bump so users get advance warning via events and the
+// cilium_crd_deprecated_field_usage_total metric instead of finding out when
+// their policies are pruned.
+var deprecatedFields = []fieldDeprecation{
+	{
+		kind:             CNPKindDefinition,
+		jsonPath:         "{.specs}",
+		sinceVersion:     "1.19",
+		removedInVersion: "2.0",
+		message:          "the specs list (multiple rule sets per CNP) is deprecated, use a single spec or CiliumClusterwideNetworkPolicy instead",
+	},
+}
+
+var deprecatedFieldUsage = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cilium",
+	Name:      "crd_deprecated_field_usage_total",
+	Help:      "Number of times a deprecated CRD field was observed populated on a custom resource",
+}, []string{"kind", "field"})
+
+func init() {
+	prometheus.MustRegister(deprecatedFieldUsage)
+}
+
+const deprecatedFieldEventReason = "CiliumDeprecatedField"
+
+// gvrForKind maps a Cilium CRD kind to the GroupVersionResource used to list
+// and watch its custom resources.
+func gvrForKind(kind string) schema.GroupVersionResource {
+	plural := map[string]string{
+		CNPKindDefinition:  "ciliumnetworkpolicies",
+		CCNPKindDefinition: "ciliumclusterwidenetworkpolicies",
+		"CiliumEndpoint":   "ciliumendpoints",
+		CNKindDefinition:   "ciliumnodes",
+		"CiliumIdentity":   "ciliumidentities",
+	}[kind]
+
+	return schema.GroupVersionResource{
+		Group:    SchemeGroupVersion.Group,
+		Version:  SchemeGroupVersion.Version,
+		Resource: plural,
+	}
+}
+
+// DeprecatedFieldWatcherConfig bundles the dependencies
+// CreateCustomResourceDefinitions needs to start the deprecated-field usage
+// watcher once CRD installation succeeds. Leave it nil when calling
+// CreateCustomResourceDefinitions to skip the watcher, e.g. in tests that
+// only care about CRD installation.
+type DeprecatedFieldWatcherConfig struct {
+	// DynClient lists and watches the custom resources the watcher checks.
+	DynClient dynamic.Interface
+	// Recorder emits the CiliumDeprecatedField event on the offending
+	// object. May be nil to only increment the metric.
+	Recorder record.EventRecorder
+	// StopCh stops every informer the watcher started when closed.
+	StopCh <-chan struct{}
+}
+
+// StartDeprecatedFieldWatcher starts one informer per Cilium CRD kind that
+// has entries in deprecatedFields. For every add/update it evaluates each
+// deprecated field's JSON path against the object; a populated match emits a
+// Warning event on the object (reason CiliumDeprecatedField) and increments
+// cilium_crd_deprecated_field_usage_total{kind,field}. It must be called
+// after CreateCustomResourceDefinitions has returned successfully; passing a
+// non-nil DeprecatedFieldWatcherConfig to CreateCustomResourceDefinitions
+// does this automatically.
+func StartDeprecatedFieldWatcher(dynClient dynamic.Interface, recorder record.EventRecorder, stopCh <-chan struct{}) {
+	byKind := make(map[string][]fieldDeprecation)
+	for _, d := range deprecatedFields {
+		byKind[d.kind] = append(byKind[d.kind], d)
+	}
+
+	for kind, fields := range byKind {
+		kind, fields := kind, fields
+
+		gvr := gvrForKind(kind)
+		if gvr.Resource == "" {
+			log.WithField("kind", kind).Error("BUG: no GroupVersionResource known for kind with deprecated fields")
+			continue
+		}
+
+		factory := dynamicinformer.NewDynamicSharedInformerFactory(dynClient, 5*time.Minute)
+		informer := factory.ForResource(gvr).Informer()
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				checkDeprecatedFields(obj, fields, recorder)
+			},
+			UpdateFunc: func(_, obj interface{}) {
+				checkDeprecatedFields(obj, fields, recorder)
+			},
+		})
+
+		go informer.Run(stopCh)
+	}
+}
+
+func checkDeprecatedFields(obj interface{}, fields []fieldDeprecation, recorder record.EventRecorder) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	for _, d := range fields {
+		jp := jsonpath.New(d.jsonPath)
+		jp.AllowMissingKeys(true)
+		if err := jp.Parse(d.jsonPath); err != nil {
+			log.WithError(err).WithField("path", d.jsonPath).Error("Invalid deprecated field JSON path")
+			continue
+		}
+
+		results, err := jp.FindResults(u.Object)
+		if err != nil || !fieldIsPopulated(results) {
+			continue
+		}
+
+		deprecatedFieldUsage.WithLabelValues(d.kind, d.jsonPath).Inc()
+
+		if recorder != nil {
+			recorder.Eventf(u, "Warning", deprecatedFieldEventReason,
+				"%s (deprecated since %s, scheduled for removal in %s): %s",
+				d.jsonPath, d.sinceVersion, d.removedInVersion, d.message)
+		}
+	}
+}
+
+// fieldIsPopulated reports whether a jsonpath.FindResults result set
+// contains at least one value, i.e. the path resolved to data rather than
+// being entirely absent. A value that is present but empty (e.g. an empty
+// list) still counts as populated.
+func fieldIsPopulated(results [][]interface{}) bool {
+	for _, row := range results {
+		if len(row) > 0 {
+			return true
+		}
+	}
+	return false
+}
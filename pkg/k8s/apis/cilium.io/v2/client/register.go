@@ -16,7 +16,6 @@ package client
 
 import (
 	"context"
-	goerrors "errors"
 	"fmt"
 	"time"
 
@@ -28,12 +27,14 @@ import (
 	"github.com/cilium/cilium/pkg/option"
 	"github.com/cilium/cilium/pkg/versioncheck"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 )
 
 const (
@@ -50,12 +51,26 @@ const (
 	// CustomResourceDefinitionGroup is the name of the third party resource group
 	CustomResourceDefinitionGroup = k8sconst.GroupName
 
-	// CustomResourceDefinitionVersion is the current version of the resource
+	// CustomResourceDefinitionVersion is the current storage version of the
+	// resource
 	CustomResourceDefinitionVersion = "v2"
 
+	// CustomResourceDefinitionSecondVersion is a second version served
+	// alongside CustomResourceDefinitionVersion for every multi-version
+	// Cilium CRD. It is not yet the storage version; it exists so that the
+	// conversion webhook path is actually exercised by a served version
+	// instead of being wired up but unreachable.
+	CustomResourceDefinitionSecondVersion = "v2alpha1"
+
 	// CustomResourceDefinitionSchemaVersion is semver-conformant version of CRD schema
 	// Used to determine if CRD needs to be updated in cluster
-	CustomResourceDefinitionSchemaVersion = "1.18"
+	//
+	// Bump this whenever a change is made to any CRD's spec, including
+	// spec.versions/spec.conversion: needsUpdateV1/needsUpdate gate every
+	// update purely on this label being stale, so a cluster already
+	// labeled with the old value would otherwise never pick up the change
+	// on upgrade.
+	CustomResourceDefinitionSchemaVersion = "1.20"
 
 	// CustomResourceDefinitionSchemaVersionKey is key to label which holds the CRD schema version
 	CustomResourceDefinitionSchemaVersionKey = "io.cilium.k8s.crd.schema.version"
@@ -72,8 +87,129 @@ const (
 
 	// CNKindDefinition is the kind name for Cilium Node
 	CNKindDefinition = "CiliumNode"
+
+	// apiextensionsV1GroupVersion is the GroupVersion served by the
+	// kube-apiserver for the apiextensions.k8s.io/v1 API. It is only
+	// present starting with Kubernetes 1.16 and is the only version
+	// available since Kubernetes 1.22, where v1beta1 was removed.
+	apiextensionsV1GroupVersion = "apiextensions.k8s.io/v1"
+
+	// ConversionWebhookPath is the HTTPS path the operator serves the
+	// ConversionReview handler on. It is referenced by every multi-version
+	// CRD's spec.conversion.webhook.clientConfig.service, and must be the
+	// same path the operator registers its ConversionReview handler at (see
+	// pkg/k8s/apis/cilium.io/conversion.RegisterHandlers).
+	ConversionWebhookPath = "/convert"
 )
 
+// ConversionWebhookConfig holds the details needed to point a CRD's
+// spec.conversion at the operator's ConversionReview endpoint. It must be
+// populated via SetConversionWebhookConfig before CreateCustomResourceDefinitions
+// is called whenever a CRD serves more than one version.
+type ConversionWebhookConfig struct {
+	// CABundle is the PEM-encoded CA bundle the apiserver uses to validate
+	// the webhook's serving certificate.
+	CABundle []byte
+	// Service identifies the operator Service fronting the webhook.
+	Service apiextensionsv1.ServiceReference
+}
+
+var conversionWebhookConfig *ConversionWebhookConfig
+
+// SetConversionWebhookConfig records the webhook coordinates used for any CRD
+// that ends up serving more than one version. Once it has been called,
+// crdVersions makes every Cilium CRD serve CustomResourceDefinitionSecondVersion
+// as well, with conversion strategy Webhook; until then every CRD serves a
+// single version with conversion strategy None.
+func SetConversionWebhookConfig(cfg ConversionWebhookConfig) {
+	conversionWebhookConfig = &cfg
+}
+
+// isOperatorLeader reports whether this process currently holds the
+// operator's leader-election lock. createUpdateCRD* only ever deletes a CRD
+// it just created itself, but it additionally requires leadership before
+// doing so: during a rollout, the old and new operator can briefly run
+// side-by-side, and only the leader should be making destructive decisions
+// about cluster-scoped objects. Agents, which do not participate in leader
+// election, default to true, which is why this guard alone never protects
+// them -- see crdHasStoredObjects below for the check that does.
+var isOperatorLeader = func() bool { return true }
+
+// SetLeaderElectionStatusFunc overrides isOperatorLeader. The operator calls
+// this with a function backed by its leaderelection.LeaderElector once it has
+// one; callers that never run leader election (e.g. the agent) can leave the
+// default in place.
+func SetLeaderElectionStatusFunc(f func() bool) {
+	isOperatorLeader = f
+}
+
+// deleteSafetyDynClient is used by crdHasStoredObjects to check live cluster
+// state immediately before handleEstablishTimeoutV1(beta1) would delete a
+// CRD. Unlike isOperatorLeader, which is only a cooperative signal between
+// operator replicas, this check is meaningful for every caller -- including
+// the agent, which never participates in leader election -- because it looks
+// at whether the CRD actually holds data rather than at who is asking to
+// delete it.
+var deleteSafetyDynClient dynamic.Interface
+
+// SetDeleteSafetyDynamicClient supplies the dynamic client crdHasStoredObjects
+// uses. CreateCustomResourceDefinitions calls this on every invocation that
+// passes a non-nil dynClient, independently of whether a
+// DeprecatedFieldWatcherConfig is also supplied. Leave it unset to keep the
+// safe default: without a way to check, handleEstablishTimeoutV1(beta1) never
+// deletes a CRD it created.
+func SetDeleteSafetyDynamicClient(c dynamic.Interface) {
+	deleteSafetyDynClient = c
+}
+
+// crdHasStoredObjects reports whether any custom resource already exists
+// under gvr. A nil deleteSafetyDynClient, or any error listing, is reported
+// as "yes, assume objects exist" so the caller refuses to delete rather than
+// risk destroying data it couldn't check for.
+func crdHasStoredObjects(gvr schema.GroupVersionResource) (bool, error) {
+	if deleteSafetyDynClient == nil {
+		return true, nil
+	}
+
+	list, err := deleteSafetyDynClient.Resource(gvr).List(context.TODO(), metav1.ListOptions{Limit: 1})
+	if err != nil {
+		return true, err
+	}
+	return len(list.Items) > 0, nil
+}
+
+// storageVersion returns the apiextensions.k8s.io/v1 served version marked
+// Storage: true, which is where a CRD's custom resources actually live.
+func storageVersion(versions []apiextensionsv1.CustomResourceDefinitionVersion) string {
+	for _, v := range versions {
+		if v.Storage {
+			return v.Name
+		}
+	}
+	return CustomResourceDefinitionVersion
+}
+
+// clusterSchemaNewerThanAgent compares the CRD schema version label found on
+// a cluster CRD against CustomResourceDefinitionSchemaVersion. A cluster
+// value that parses and is strictly greater means a newer agent/operator
+// already installed this CRD with a schema we don't understand yet -- e.g.
+// because of a rollback, or because two different Cilium versions are
+// racing to install the same CRD. In that case we must leave the CRD alone
+// rather than silently downgrading it.
+func clusterSchemaNewerThanAgent(labels map[string]string) (bool, error) {
+	v, ok := labels[CustomResourceDefinitionSchemaVersionKey]
+	if !ok {
+		return false, nil
+	}
+
+	clusterVersion, err := versioncheck.Version(v)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse %s label %q: %w", CustomResourceDefinitionSchemaVersionKey, v, err)
+	}
+
+	return clusterVersion.GT(comparableCRDSchemaVersion), nil
+}
+
 // SchemeGroupVersion is group version used to register these objects
 var SchemeGroupVersion = schema.GroupVersion{
 	Group:   CustomResourceDefinitionGroup,
@@ -85,8 +221,19 @@ var (
 )
 
 // CreateCustomResourceDefinitions creates our CRD objects in the kubernetes
-// cluster
-func CreateCustomResourceDefinitions(clientset apiextensionsclient.Interface) error {
+// cluster. When dynClient is non-nil, it is registered via
+// SetDeleteSafetyDynamicClient before any CRD is installed, so that
+// handleEstablishTimeoutV1(beta1) can check live cluster state before
+// deleting a CRD it created; this is independent of watcherCfg; pass dynClient
+// even if watcherCfg is nil to get delete-safety checks without the
+// deprecated-field watcher. When watcherCfg is non-nil, it also starts the
+// deprecated-field usage watcher (see StartDeprecatedFieldWatcher) once every
+// CRD above is installed.
+func CreateCustomResourceDefinitions(clientset apiextensionsclient.Interface, dynClient dynamic.Interface, watcherCfg *DeprecatedFieldWatcherConfig) error {
+	if dynClient != nil {
+		SetDeleteSafetyDynamicClient(dynClient)
+	}
+
 	if err := createCNPCRD(clientset); err != nil {
 		return err
 	}
@@ -109,9 +256,32 @@ func CreateCustomResourceDefinitions(clientset apiextensionsclient.Interface) er
 		}
 	}
 
+	if watcherCfg != nil {
+		StartDeprecatedFieldWatcher(watcherCfg.DynClient, watcherCfg.Recorder, watcherCfg.StopCh)
+	}
+
 	return nil
 }
 
+// serverSupportsV1CRD returns true if the apiserver we are talking to serves
+// the apiextensions.k8s.io/v1 API. Kubernetes clusters older than 1.16 only
+// serve v1beta1, and v1beta1 is removed entirely starting with 1.22, so we
+// have to pick the CRD install path dynamically via discovery.
+func serverSupportsV1CRD(clientset apiextensionsclient.Interface) bool {
+	resources, err := clientset.Discovery().ServerResourcesForGroupVersion(apiextensionsV1GroupVersion)
+	if err != nil {
+		return false
+	}
+
+	for _, r := range resources.APIResources {
+		if r.Kind == "CustomResourceDefinition" {
+			return true
+		}
+	}
+
+	return false
+}
+
 // createCNPCRD creates and updates the CiliumNetworkPolicies CRD. It should be called
 // on agent startup but is idempotent and safe to call again.
 func createCNPCRD(clientset apiextensionsclient.Interface) error {
@@ -148,7 +318,31 @@ func createCNPCRD(clientset apiextensionsclient.Interface) error {
 		},
 	}
 
-	return createUpdateCRD(clientset, "CiliumNetworkPolicy/v2", res)
+	versions := crdVersions(&cnpCRV, convertPrinterColumns(ciliumCRD.Spec.AdditionalPrinterColumns), convertSubresources(ciliumCRD.Spec.Subresources))
+
+	resV1 := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ciliumCRD.Spec.Names.Plural + "." + SchemeGroupVersion.Group,
+			Labels: map[string]string{
+				CustomResourceDefinitionSchemaVersionKey: CustomResourceDefinitionSchemaVersion,
+			},
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: SchemeGroupVersion.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:     ciliumCRD.Spec.Names.Plural,
+				Singular:   ciliumCRD.Spec.Names.Singular,
+				ShortNames: ciliumCRD.Spec.Names.ShortNames,
+				Kind:       ciliumCRD.Spec.Names.Kind,
+			},
+			Scope:                 apiextensionsv1.ResourceScope(ciliumCRD.Spec.Scope),
+			Versions:              versions,
+			PreserveUnknownFields: false,
+			Conversion:            crdConversion(len(versions)),
+		},
+	}
+
+	return createUpdateCRD(clientset, "CiliumNetworkPolicy/v2", resV1, res)
 }
 
 // createCGNPCRD creates and updates the CiliumGlobalNetworkPolicies CRD. It should be called
@@ -186,7 +380,31 @@ func createCCNPCRD(clientset apiextensionsclient.Interface) error {
 		},
 	}
 
-	return createUpdateCRD(clientset, "CiliumClusterwideNetworkPolicy/v2", res)
+	versions := crdVersions(&ccnpCRV, nil, convertSubresources(ciliumCRD.Spec.Subresources))
+
+	resV1 := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ciliumCRD.Spec.Names.Plural + "." + SchemeGroupVersion.Group,
+			Labels: map[string]string{
+				CustomResourceDefinitionSchemaVersionKey: CustomResourceDefinitionSchemaVersion,
+			},
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: SchemeGroupVersion.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:     ciliumCRD.Spec.Names.Plural,
+				Singular:   ciliumCRD.Spec.Names.Singular,
+				ShortNames: ciliumCRD.Spec.Names.ShortNames,
+				Kind:       ciliumCRD.Spec.Names.Kind,
+			},
+			Scope:                 apiextensionsv1.ResourceScope(ciliumCRD.Spec.Scope),
+			Versions:              versions,
+			PreserveUnknownFields: false,
+			Conversion:            crdConversion(len(versions)),
+		},
+	}
+
+	return createUpdateCRD(clientset, "CiliumClusterwideNetworkPolicy/v2", resV1, res)
 }
 
 // createCEPCRD creates and updates the CiliumEndpoint CRD. It should be called
@@ -226,7 +444,31 @@ func createCEPCRD(clientset apiextensionsclient.Interface) error {
 		},
 	}
 
-	return createUpdateCRD(clientset, "v2.CiliumEndpoint", res)
+	versions := crdVersions(&cepCRV, convertPrinterColumns(ciliumCRD.Spec.AdditionalPrinterColumns), convertSubresources(ciliumCRD.Spec.Subresources))
+
+	resV1 := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ciliumCRD.Spec.Names.Plural + "." + SchemeGroupVersion.Group,
+			Labels: map[string]string{
+				CustomResourceDefinitionSchemaVersionKey: CustomResourceDefinitionSchemaVersion,
+			},
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: SchemeGroupVersion.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:     ciliumCRD.Spec.Names.Plural,
+				Singular:   ciliumCRD.Spec.Names.Singular,
+				ShortNames: ciliumCRD.Spec.Names.ShortNames,
+				Kind:       ciliumCRD.Spec.Names.Kind,
+			},
+			Scope:                 apiextensionsv1.ResourceScope(ciliumCRD.Spec.Scope),
+			Versions:              versions,
+			PreserveUnknownFields: false,
+			Conversion:            crdConversion(len(versions)),
+		},
+	}
+
+	return createUpdateCRD(clientset, "v2.CiliumEndpoint", resV1, res)
 }
 
 // createNodeCRD creates and updates the CiliumNode CRD. It should be called on
@@ -265,7 +507,31 @@ func createNodeCRD(clientset apiextensionsclient.Interface) error {
 		},
 	}
 
-	return createUpdateCRD(clientset, "v2.CiliumNode", res)
+	versions := crdVersions(&cnCRV, nil, convertSubresources(ciliumCRD.Spec.Subresources))
+
+	resV1 := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ciliumCRD.Spec.Names.Plural + "." + SchemeGroupVersion.Group,
+			Labels: map[string]string{
+				CustomResourceDefinitionSchemaVersionKey: CustomResourceDefinitionSchemaVersion,
+			},
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: SchemeGroupVersion.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:     ciliumCRD.Spec.Names.Plural,
+				Singular:   ciliumCRD.Spec.Names.Singular,
+				ShortNames: ciliumCRD.Spec.Names.ShortNames,
+				Kind:       ciliumCRD.Spec.Names.Kind,
+			},
+			Scope:                 apiextensionsv1.ResourceScope(ciliumCRD.Spec.Scope),
+			Versions:              versions,
+			PreserveUnknownFields: false,
+			Conversion:            crdConversion(len(versions)),
+		},
+	}
+
+	return createUpdateCRD(clientset, "v2.CiliumNode", resV1, res)
 }
 
 // createIdentityCRD creates and updates the CiliumIdentity CRD. It should be
@@ -303,12 +569,351 @@ func createIdentityCRD(clientset apiextensionsclient.Interface) error {
 		},
 	}
 
-	return createUpdateCRD(clientset, "v2.CiliumIdentity", res)
+	versions := crdVersions(&ciCRV, nil, convertSubresources(ciliumCRD.Spec.Subresources))
+
+	resV1 := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ciliumCRD.Spec.Names.Plural + "." + SchemeGroupVersion.Group,
+			Labels: map[string]string{
+				CustomResourceDefinitionSchemaVersionKey: CustomResourceDefinitionSchemaVersion,
+			},
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: SchemeGroupVersion.Group,
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:     ciliumCRD.Spec.Names.Plural,
+				Singular:   ciliumCRD.Spec.Names.Singular,
+				ShortNames: ciliumCRD.Spec.Names.ShortNames,
+				Kind:       ciliumCRD.Spec.Names.Kind,
+			},
+			Scope:                 apiextensionsv1.ResourceScope(ciliumCRD.Spec.Scope),
+			Versions:              versions,
+			PreserveUnknownFields: false,
+			Conversion:            crdConversion(len(versions)),
+		},
+	}
+
+	return createUpdateCRD(clientset, "v2.CiliumIdentity", resV1, res)
+}
+
+// convertPrinterColumns converts the apiextensions/v1beta1 additionalPrinterColumns,
+// which lived at spec level, into their apiextensions/v1 shape, which moved
+// per-version.
+func convertPrinterColumns(columns []apiextensionsv1beta1.CustomResourceColumnDefinition) []apiextensionsv1.CustomResourceColumnDefinition {
+	if len(columns) == 0 {
+		return nil
+	}
+
+	out := make([]apiextensionsv1.CustomResourceColumnDefinition, 0, len(columns))
+	for _, c := range columns {
+		out = append(out, apiextensionsv1.CustomResourceColumnDefinition{
+			Name:        c.Name,
+			Type:        c.Type,
+			Format:      c.Format,
+			Description: c.Description,
+			Priority:    c.Priority,
+			JSONPath:    c.JSONPath,
+		})
+	}
+	return out
+}
+
+// convertSubresources converts the apiextensions/v1beta1 subresources, which
+// lived at spec level, into their apiextensions/v1 shape, which moved
+// per-version.
+func convertSubresources(sub *apiextensionsv1beta1.CustomResourceSubresources) *apiextensionsv1.CustomResourceSubresources {
+	if sub == nil {
+		return nil
+	}
+
+	out := &apiextensionsv1.CustomResourceSubresources{}
+	if sub.Status != nil {
+		out.Status = &apiextensionsv1.CustomResourceSubresourceStatus{}
+	}
+	if sub.Scale != nil {
+		out.Scale = &apiextensionsv1.CustomResourceSubresourceScale{
+			SpecReplicasPath:   sub.Scale.SpecReplicasPath,
+			StatusReplicasPath: sub.Scale.StatusReplicasPath,
+			LabelSelectorPath:  sub.Scale.LabelSelectorPath,
+		}
+	}
+	return out
+}
+
+// crdVersions builds the spec.versions entries for a Cilium CRD. It always
+// serves CustomResourceDefinitionVersion (the storage version). It only adds
+// CustomResourceDefinitionSecondVersion -- and so only makes the conversion
+// webhook path (see crdConversion) reachable -- once SetConversionWebhookConfig
+// has been called, so that a cluster whose operator hasn't been configured
+// with a webhook endpoint stays on a single served version with conversion
+// strategy None rather than being pushed onto a second API version it has no
+// way to convert. Both versions share the same schema, printer columns and
+// subresources for now, ahead of the schema actually diverging between them.
+func crdVersions(crdSchema *apiextensionsv1.JSONSchemaProps, printerColumns []apiextensionsv1.CustomResourceColumnDefinition, subresources *apiextensionsv1.CustomResourceSubresources) []apiextensionsv1.CustomResourceDefinitionVersion {
+	validation := &apiextensionsv1.CustomResourceValidation{OpenAPIV3Schema: crdSchema}
+	versions := []apiextensionsv1.CustomResourceDefinitionVersion{
+		{
+			Name:                     CustomResourceDefinitionVersion,
+			Served:                   true,
+			Storage:                  true,
+			AdditionalPrinterColumns: printerColumns,
+			Subresources:             subresources,
+			Schema:                   validation,
+		},
+	}
+
+	if conversionWebhookConfig == nil {
+		return versions
+	}
+
+	return append(versions, apiextensionsv1.CustomResourceDefinitionVersion{
+		Name:                     CustomResourceDefinitionSecondVersion,
+		Served:                   true,
+		Storage:                  false,
+		AdditionalPrinterColumns: printerColumns,
+		Subresources:             subresources,
+		Schema:                   validation,
+	})
+}
+
+// crdConversion returns the conversion strategy for a CRD serving
+// servedVersionCount versions. A single served version never needs
+// conversion, so it uses strategy None; as soon as a second version is
+// served (CustomResourceDefinitionSecondVersion) it switches to the Webhook
+// strategy, pointed at the operator's ConversionReview endpoint configured
+// via SetConversionWebhookConfig.
+func crdConversion(servedVersionCount int) *apiextensionsv1.CustomResourceConversion {
+	if servedVersionCount <= 1 {
+		return &apiextensionsv1.CustomResourceConversion{
+			Strategy: apiextensionsv1.NoneConverter,
+		}
+	}
+
+	if conversionWebhookConfig == nil {
+		log.Error("BUG: CRD serves more than one version but no conversion webhook was configured via SetConversionWebhookConfig")
+		return &apiextensionsv1.CustomResourceConversion{
+			Strategy: apiextensionsv1.NoneConverter,
+		}
+	}
+
+	path := ConversionWebhookPath
+	return &apiextensionsv1.CustomResourceConversion{
+		Strategy: apiextensionsv1.WebhookConverter,
+		Webhook: &apiextensionsv1.WebhookConversion{
+			ClientConfig: &apiextensionsv1.WebhookClientConfig{
+				CABundle: conversionWebhookConfig.CABundle,
+				Service: &apiextensionsv1.ServiceReference{
+					Namespace: conversionWebhookConfig.Service.Namespace,
+					Name:      conversionWebhookConfig.Service.Name,
+					Path:      &path,
+					Port:      conversionWebhookConfig.Service.Port,
+				},
+			},
+			ConversionReviewVersions: []string{"v1"},
+		},
+	}
 }
 
 // createUpdateCRD ensures the CRD object is installed into the k8s cluster. It
-// will create or update the CRD and it's validation when needed
-func createUpdateCRD(clientset apiextensionsclient.Interface,
+// will create or update the CRD and it's validation when needed. The
+// apiextensions.k8s.io/v1 API is preferred whenever the apiserver serves it;
+// the v1beta1 object is only used as a fallback for Kubernetes clusters older
+// than 1.16, which do not serve v1 at all.
+func createUpdateCRD(
+	clientset apiextensionsclient.Interface,
+	crdName string,
+	crdV1 *apiextensionsv1.CustomResourceDefinition,
+	crdV1beta1 *apiextensionsv1beta1.CustomResourceDefinition) error {
+
+	if serverSupportsV1CRD(clientset) {
+		return createUpdateCRDv1(clientset, crdName, crdV1)
+	}
+
+	log.WithField("name", crdName).Warning(
+		"apiserver does not serve apiextensions.k8s.io/v1; falling back to the " +
+			"deprecated v1beta1 CRD installation path. Upgrade to Kubernetes >= 1.16 " +
+			"to pick up structural schema validation and field pruning")
+	return createUpdateCRDv1beta1(clientset, crdName, crdV1beta1)
+}
+
+// createUpdateCRDv1 is the apiextensions.k8s.io/v1 counterpart of
+// createUpdateCRDv1beta1 below. See its doc comment for the general
+// algorithm; the differences are the API group used, that the v1 API always
+// requires a structural, pruning schema, and that the update decision is
+// needsUpdateV1 alone, which looks only at the schema version label.
+func createUpdateCRDv1(clientset apiextensionsclient.Interface, crdName string, crd *apiextensionsv1.CustomResourceDefinition) error {
+	scopedLog := log.WithField("name", crdName)
+
+	clusterCRD, err := clientset.ApiextensionsV1().CustomResourceDefinitions().Get(
+		context.TODO(),
+		crd.ObjectMeta.Name,
+		metav1.GetOptions{})
+	createdByUs := false
+	if errors.IsNotFound(err) {
+		scopedLog.Info("Creating CRD (CustomResourceDefinition)...")
+
+		clusterCRD, err = clientset.ApiextensionsV1().CustomResourceDefinitions().Create(
+			context.TODO(),
+			crd,
+			metav1.CreateOptions{})
+		// This occurs when multiple agents race to create the CRD. Since another has
+		// created it, it will also update it, hence the non-error return.
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+		createdByUs = err == nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if newer, skewErr := clusterSchemaNewerThanAgent(clusterCRD.Labels); skewErr != nil {
+		scopedLog.WithError(skewErr).Warning("Unable to determine cluster CRD schema version, continuing anyway")
+	} else if newer {
+		return fmt.Errorf("cluster %s CRD has schema version %q, newer than this agent's %q; refusing to touch it to avoid a destructive downgrade",
+			crdName, clusterCRD.Labels[CustomResourceDefinitionSchemaVersionKey], CustomResourceDefinitionSchemaVersion)
+	}
+
+	scopedLog.Debug("Checking if CRD (CustomResourceDefinition) needs update...")
+
+	if needsUpdateV1(clusterCRD) {
+		scopedLog.Info("Updating CRD (CustomResourceDefinition)...")
+
+		err = wait.Poll(500*time.Millisecond, 60*time.Second, func() (bool, error) {
+			clusterCRD, err = clientset.ApiextensionsV1().CustomResourceDefinitions().Get(
+				context.TODO(),
+				crd.ObjectMeta.Name,
+				metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+
+			if needsUpdateV1(clusterCRD) {
+				scopedLog.Debug("CRD validation is different, updating it...")
+
+				clusterCRD.ObjectMeta.Labels = crd.ObjectMeta.Labels
+				clusterCRD.Spec = crd.Spec
+
+				_, err = clientset.ApiextensionsV1().CustomResourceDefinitions().Update(
+					context.TODO(),
+					clusterCRD,
+					metav1.UpdateOptions{})
+				if err == nil {
+					return true, nil
+				}
+
+				scopedLog.WithError(err).Debug("Unable to update CRD validation")
+				return false, err
+			}
+
+			return true, nil
+		})
+		if err != nil {
+			scopedLog.WithError(err).Error("Unable to update CRD")
+			return err
+		}
+	}
+
+	scopedLog.Debug("Waiting for CRD (CustomResourceDefinition) to be available...")
+	err = wait.Poll(500*time.Millisecond, 60*time.Second, func() (bool, error) {
+		for _, cond := range clusterCRD.Status.Conditions {
+			switch cond.Type {
+			case apiextensionsv1.Established:
+				if cond.Status == apiextensionsv1.ConditionTrue {
+					return true, nil
+				}
+			case apiextensionsv1.NamesAccepted:
+				if cond.Status == apiextensionsv1.ConditionFalse {
+					return false, fmt.Errorf("name conflict for CRD %s: %s", crdName, cond.Reason)
+				}
+			}
+		}
+		clusterCRD, err = clientset.ApiextensionsV1().CustomResourceDefinitions().Get(
+			context.TODO(),
+			crd.ObjectMeta.Name,
+			metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return false, nil
+	})
+	if err != nil {
+		return handleEstablishTimeoutV1(clientset, crdName, crd, createdByUs, err)
+	}
+
+	scopedLog.Info("CRD (CustomResourceDefinition) is installed and up-to-date")
+	return nil
+}
+
+// handleEstablishTimeoutV1 is invoked when createUpdateCRDv1 gives up waiting
+// for the CRD to become Established (typically a name conflict or the
+// apiserver never converging). Deleting the CRD unconditionally here would
+// destroy every CNP/CEP/CiliumNode/etc. a cluster's users have stored under
+// it -- including when establishErr is unrelated to this call (e.g. a
+// concurrent agent with a different version is mid-install). So we only ever
+// consider deleting a CRD that this call created moments ago and only while
+// holding operator leadership, and even then we re-check live cluster state
+// via crdHasStoredObjects immediately before the delete: isOperatorLeader is
+// a no-op for the agent (it always reports true there), so it is
+// crdHasStoredObjects, not leadership, that actually stops an agent from
+// nuking a CRD that another agent or user has since written data into. Any
+// pre-existing CRD, or one we can't confirm is empty, is left untouched and
+// the error is simply returned for the caller to retry on the next restart.
+func handleEstablishTimeoutV1(clientset apiextensionsclient.Interface, crdName string, crd *apiextensionsv1.CustomResourceDefinition, createdByUs bool, establishErr error) error {
+	scopedLog := log.WithField("name", crdName)
+
+	if !createdByUs || !isOperatorLeader() {
+		return fmt.Errorf("CRD %s did not become established: %w (leaving existing CRD in place)", crdName, establishErr)
+	}
+
+	scopedLog.WithError(establishErr).Warning("CRD failed to establish within the initial timeout, retrying before giving up")
+	retryErr := wait.Poll(2*time.Second, 2*time.Minute, func() (bool, error) {
+		cur, getErr := clientset.ApiextensionsV1().CustomResourceDefinitions().Get(
+			context.TODO(),
+			crd.ObjectMeta.Name,
+			metav1.GetOptions{})
+		if getErr != nil {
+			return false, getErr
+		}
+		for _, cond := range cur.Status.Conditions {
+			if cond.Type == apiextensionsv1.Established && cond.Status == apiextensionsv1.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if retryErr == nil {
+		scopedLog.Info("CRD (CustomResourceDefinition) is installed and up-to-date")
+		return nil
+	}
+
+	gvr := schema.GroupVersionResource{
+		Group:    crd.Spec.Group,
+		Version:  storageVersion(crd.Spec.Versions),
+		Resource: crd.Spec.Names.Plural,
+	}
+	if hasObjects, checkErr := crdHasStoredObjects(gvr); checkErr != nil || hasObjects {
+		scopedLog.WithError(retryErr).Error("CRD we created still failed to establish, but refusing to delete it: unable to confirm it holds no stored custom resources")
+		return retryErr
+	}
+
+	scopedLog.WithError(retryErr).Error("CRD we created still failed to establish; deleting it")
+	deleteErr := clientset.ApiextensionsV1().CustomResourceDefinitions().Delete(
+		context.TODO(),
+		crd.ObjectMeta.Name,
+		metav1.DeleteOptions{})
+	if deleteErr != nil {
+		return fmt.Errorf("unable to delete k8s %s CRD %s. Deleting CRD due: %s",
+			crdName, deleteErr, retryErr)
+	}
+	return retryErr
+}
+
+// createUpdateCRDv1beta1 ensures the CRD object is installed into the k8s
+// cluster via the deprecated apiextensions.k8s.io/v1beta1 API. It will create
+// or update the CRD and its validation when needed. It is only used as a
+// fallback for Kubernetes clusters older than 1.16.
+func createUpdateCRDv1beta1(clientset apiextensionsclient.Interface,
 	crdName string,
 	crd *apiextensionsv1beta1.CustomResourceDefinition) error {
 
@@ -318,6 +923,7 @@ func createUpdateCRD(clientset apiextensionsclient.Interface,
 		context.TODO(),
 		crd.ObjectMeta.Name,
 		metav1.GetOptions{})
+	createdByUs := false
 	if errors.IsNotFound(err) {
 		scopedLog.Info("Creating CRD (CustomResourceDefinition)...")
 
@@ -330,11 +936,19 @@ func createUpdateCRD(clientset apiextensionsclient.Interface,
 		if errors.IsAlreadyExists(err) {
 			return nil
 		}
+		createdByUs = err == nil
 	}
 	if err != nil {
 		return err
 	}
 
+	if newer, skewErr := clusterSchemaNewerThanAgent(clusterCRD.Labels); skewErr != nil {
+		scopedLog.WithError(skewErr).Warning("Unable to determine cluster CRD schema version, continuing anyway")
+	} else if newer {
+		return fmt.Errorf("cluster %s CRD has schema version %q, newer than this agent's %q; refusing to touch it to avoid a destructive downgrade",
+			crdName, clusterCRD.Labels[CustomResourceDefinitionSchemaVersionKey], CustomResourceDefinitionSchemaVersion)
+	}
+
 	scopedLog.Debug("Checking if CRD (CustomResourceDefinition) needs update...")
 
 	if crd.Spec.Validation != nil &&
@@ -389,12 +1003,11 @@ func createUpdateCRD(clientset apiextensionsclient.Interface,
 			switch cond.Type {
 			case apiextensionsv1beta1.Established:
 				if cond.Status == apiextensionsv1beta1.ConditionTrue {
-					return true, err
+					return true, nil
 				}
 			case apiextensionsv1beta1.NamesAccepted:
 				if cond.Status == apiextensionsv1beta1.ConditionFalse {
-					scopedLog.WithError(goerrors.New(cond.Reason)).Error("Name conflict for CRD")
-					return false, err
+					return false, fmt.Errorf("name conflict for CRD %s: %s", crdName, cond.Reason)
 				}
 			}
 		}
@@ -405,22 +1018,68 @@ func createUpdateCRD(clientset apiextensionsclient.Interface,
 		if err != nil {
 			return false, err
 		}
-		return false, err
+		return false, nil
 	})
 	if err != nil {
-		deleteErr := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(
+		return handleEstablishTimeoutV1beta1(clientset, crdName, crd, createdByUs, err)
+	}
+
+	scopedLog.Info("CRD (CustomResourceDefinition) is installed and up-to-date")
+	return nil
+}
+
+// handleEstablishTimeoutV1beta1 is the v1beta1 counterpart of
+// handleEstablishTimeoutV1; see its doc comment for the rationale, including
+// why crdHasStoredObjects rather than isOperatorLeader is what actually
+// protects the agent here.
+func handleEstablishTimeoutV1beta1(clientset apiextensionsclient.Interface, crdName string, crd *apiextensionsv1beta1.CustomResourceDefinition, createdByUs bool, establishErr error) error {
+	scopedLog := log.WithField("name", crdName)
+
+	if !createdByUs || !isOperatorLeader() {
+		return fmt.Errorf("CRD %s did not become established: %w (leaving existing CRD in place)", crdName, establishErr)
+	}
+
+	scopedLog.WithError(establishErr).Warning("CRD failed to establish within the initial timeout, retrying before giving up")
+	retryErr := wait.Poll(2*time.Second, 2*time.Minute, func() (bool, error) {
+		cur, getErr := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Get(
 			context.TODO(),
 			crd.ObjectMeta.Name,
-			metav1.DeleteOptions{})
-		if deleteErr != nil {
-			return fmt.Errorf("unable to delete k8s %s CRD %s. Deleting CRD due: %s",
-				crdName, deleteErr, err)
+			metav1.GetOptions{})
+		if getErr != nil {
+			return false, getErr
 		}
-		return err
+		for _, cond := range cur.Status.Conditions {
+			if cond.Type == apiextensionsv1beta1.Established && cond.Status == apiextensionsv1beta1.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if retryErr == nil {
+		scopedLog.Info("CRD (CustomResourceDefinition) is installed and up-to-date")
+		return nil
 	}
 
-	scopedLog.Info("CRD (CustomResourceDefinition) is installed and up-to-date")
-	return nil
+	gvr := schema.GroupVersionResource{
+		Group:    crd.Spec.Group,
+		Version:  crd.Spec.Version,
+		Resource: crd.Spec.Names.Plural,
+	}
+	if hasObjects, checkErr := crdHasStoredObjects(gvr); checkErr != nil || hasObjects {
+		scopedLog.WithError(retryErr).Error("CRD we created still failed to establish, but refusing to delete it: unable to confirm it holds no stored custom resources")
+		return retryErr
+	}
+
+	scopedLog.WithError(retryErr).Error("CRD we created still failed to establish; deleting it")
+	deleteErr := clientset.ApiextensionsV1beta1().CustomResourceDefinitions().Delete(
+		context.TODO(),
+		crd.ObjectMeta.Name,
+		metav1.DeleteOptions{})
+	if deleteErr != nil {
+		return fmt.Errorf("unable to delete k8s %s CRD %s. Deleting CRD due: %s",
+			crdName, deleteErr, retryErr)
+	}
+	return retryErr
 }
 
 func needsUpdate(clusterCRD *apiextensionsv1beta1.CustomResourceDefinition) bool {
@@ -444,15 +1103,168 @@ func needsUpdate(clusterCRD *apiextensionsv1beta1.CustomResourceDefinition) bool
 	return false
 }
 
+func needsUpdateV1(clusterCRD *apiextensionsv1.CustomResourceDefinition) bool {
+	v, ok := clusterCRD.Labels[CustomResourceDefinitionSchemaVersionKey]
+	if !ok {
+		// no schema version detected
+		return true
+	}
+
+	clusterVersion, err := versioncheck.Version(v)
+	if err != nil || clusterVersion.LT(comparableCRDSchemaVersion) {
+		// version in cluster is either unparsable or smaller than current version
+		return true
+	}
+
+	return false
+}
+
 var (
-	// cepCRV is a minimal validation for CEP objects. Since only the agent is
-	// creating them, it is better to be permissive and have some data, if buggy,
-	// than to have no data in k8s.
-	cepCRV = apiextensionsv1beta1.CustomResourceValidation{
-		OpenAPIV3Schema: &apiextensionsv1beta1.JSONSchemaProps{},
+	// cepCRV is the structural OpenAPI v3 schema for CEP objects. Since only
+	// the agent is creating them, it is better to be permissive on the
+	// free-form bits (endpoint status, encryption, networking) and have some
+	// data, if buggy, than to have no data in k8s. Those subtrees are
+	// therefore marked to preserve unknown fields rather than validated
+	// field-by-field.
+	cepCRV = apiextensionsv1.JSONSchemaProps{
+		Type:        "object",
+		Description: "CiliumEndpoint is the status of a Cilium managed endpoint.",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"status": {
+				Type:                   "object",
+				XPreserveUnknownFields: boolPtr(true),
+			},
+		},
+	}
+
+	// endpointSelectorCRV is the structural schema shared by every field that
+	// holds a Cilium EndpointSelector (CNP/CCNP endpointSelector, nodeSelector,
+	// and the selectors embedded in ingress/egress rules). matchLabels keys and
+	// matchExpressions bodies are free-form user label names, so those leaves
+	// stay preserve-unknown while the selector's own shape is structural.
+	endpointSelectorCRV = apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"matchLabels": {
+				Type:                   "object",
+				XPreserveUnknownFields: boolPtr(true),
+			},
+			"matchExpressions": {
+				Type: "array",
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{
+					Schema: &apiextensionsv1.JSONSchemaProps{
+						Type:                   "object",
+						XPreserveUnknownFields: boolPtr(true),
+					},
+				},
+			},
+		},
+	}
+
+	// networkPolicyRuleCRV is the schema for a single ingress/egress rule. The
+	// rule body (FQDN/DNS/HTTP/Kafka/ICMP matchers, CIDR sets, entity lists,
+	// ...) is versioned independently of the CRD schema bump cadence, so it is
+	// intentionally left preserve-unknown rather than force-fitting every rule
+	// shape in here; only the rule's toEndpoints/fromEndpoints selectors are
+	// common enough across rule types to validate structurally.
+	networkPolicyRuleCRV = apiextensionsv1.JSONSchemaProps{
+		Type:                   "object",
+		XPreserveUnknownFields: boolPtr(true),
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"toEndpoints":   {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &endpointSelectorCRV}},
+			"fromEndpoints": {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &endpointSelectorCRV}},
+		},
+	}
+
+	// networkPolicySpecCRV is the structural schema for a single CNP/CCNP
+	// spec (and each entry of the "specs" list, for the multi-rule-set form).
+	// The well-known top-level rule keys are declared so pruning/defaulting
+	// has something to act on; only the deep, independently-versioned rule
+	// bodies stay preserve-unknown.
+	networkPolicySpecCRV = apiextensionsv1.JSONSchemaProps{
+		Type: "object",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"description":      {Type: "string"},
+			"endpointSelector": endpointSelectorCRV,
+			"nodeSelector":     endpointSelectorCRV,
+			"labels": {
+				Type: "array",
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{
+					Schema: &apiextensionsv1.JSONSchemaProps{
+						Type:                   "object",
+						XPreserveUnknownFields: boolPtr(true),
+					},
+				},
+			},
+			"ingress":     {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &networkPolicyRuleCRV}},
+			"ingressDeny": {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &networkPolicyRuleCRV}},
+			"egress":      {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &networkPolicyRuleCRV}},
+			"egressDeny":  {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &networkPolicyRuleCRV}},
+		},
 	}
 
-	cnpCRV = apiextensionsv1beta1.CustomResourceValidation{
-		OpenAPIV3Schema: &apiextensionsv1beta1.JSONSchemaProps{},
+	cnpCRV = apiextensionsv1.JSONSchemaProps{
+		Type:        "object",
+		Description: "CiliumNetworkPolicy is a Kubernetes third-party resource with an extended version of NetworkPolicy.",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"metadata": {
+				Type: "object",
+			},
+			"spec":  networkPolicySpecCRV,
+			"specs": {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &networkPolicySpecCRV}},
+			// Status is written per-node by every agent enforcing the policy
+			// and keyed by node name, so its shape isn't known up front; it
+			// stays preserve-unknown rather than structural.
+			"status": {
+				Type:                   "object",
+				XPreserveUnknownFields: boolPtr(true),
+			},
+		},
+	}
+
+	ccnpCRV = apiextensionsv1.JSONSchemaProps{
+		Type:        "object",
+		Description: "CiliumClusterwideNetworkPolicy is a Kubernetes third-party resource with an extended version of NetworkPolicy which is cluster scoped rather than namespace scoped.",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"metadata": {
+				Type: "object",
+			},
+			"spec":  networkPolicySpecCRV,
+			"specs": {Type: "array", Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &networkPolicySpecCRV}},
+			"status": {
+				Type:                   "object",
+				XPreserveUnknownFields: boolPtr(true),
+			},
+		},
+	}
+
+	cnCRV = apiextensionsv1.JSONSchemaProps{
+		Type:        "object",
+		Description: "CiliumNode represents a node managed by Cilium. It contains a specification to control various node specific configuration aspects, and a status containing the status of the node.",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"spec": {
+				Type:                   "object",
+				XPreserveUnknownFields: boolPtr(true),
+			},
+			"status": {
+				Type:                   "object",
+				XPreserveUnknownFields: boolPtr(true),
+			},
+		},
+	}
+
+	ciCRV = apiextensionsv1.JSONSchemaProps{
+		Type:        "object",
+		Description: "CiliumIdentity is a CRD that represents an identity managed by Cilium. It is intended as a backing store for identity allocation, acting as the source of truth for the cluster for identities.",
+		Properties: map[string]apiextensionsv1.JSONSchemaProps{
+			"security-labels": {
+				Type:                   "object",
+				XPreserveUnknownFields: boolPtr(true),
+			},
+		},
 	}
 )
+
+func boolPtr(b bool) *bool {
+	return &b
+}
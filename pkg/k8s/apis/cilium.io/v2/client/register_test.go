@@ -0,0 +1,135 @@
+// Copyright 2017-2020 Authors of Cilium
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ktesting "k8s.io/client-go/testing"
+)
+
+func testCRD(name string, labels map[string]string) *apiextensionsv1.CustomResourceDefinition {
+	return &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Group: "cilium.io",
+			Names: apiextensionsv1.CustomResourceDefinitionNames{
+				Plural:   "ciliumnetworkpolicies",
+				Singular: "ciliumnetworkpolicy",
+				Kind:     CNPKindDefinition,
+			},
+			Scope: apiextensionsv1.ClusterScoped,
+			Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+				{Name: CustomResourceDefinitionVersion, Served: true, Storage: true},
+			},
+			Conversion: &apiextensionsv1.CustomResourceConversion{Strategy: apiextensionsv1.NoneConverter},
+		},
+	}
+}
+
+// TestCreateUpdateCRDv1RefusesDowngrade checks that createUpdateCRDv1 leaves a
+// cluster CRD alone, rather than overwriting it, when that CRD's schema
+// version label is newer than CustomResourceDefinitionSchemaVersion -- the
+// rollback/version-skew scenario clusterSchemaNewerThanAgent exists for.
+func TestCreateUpdateCRDv1RefusesDowngrade(t *testing.T) {
+	crdName := "ciliumnetworkpolicies.cilium.io"
+	newerLabels := map[string]string{
+		CustomResourceDefinitionSchemaVersionKey: "99.0.0",
+	}
+	existing := testCRD(crdName, newerLabels)
+
+	clientset := apiextensionsfake.NewSimpleClientset(existing)
+
+	crd := testCRD(crdName, map[string]string{
+		CustomResourceDefinitionSchemaVersionKey: CustomResourceDefinitionSchemaVersion,
+	})
+
+	err := createUpdateCRDv1(clientset, "CiliumNetworkPolicy/v2", crd)
+	if err == nil {
+		t.Fatal("expected createUpdateCRDv1 to refuse to touch a CRD with a newer schema version, got nil error")
+	}
+
+	got, getErr := clientset.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), crdName, metav1.GetOptions{})
+	if getErr != nil {
+		t.Fatalf("unexpected error fetching CRD: %s", getErr)
+	}
+	if got.Labels[CustomResourceDefinitionSchemaVersionKey] != "99.0.0" {
+		t.Fatalf("CRD schema version label was overwritten: got %q, want %q",
+			got.Labels[CustomResourceDefinitionSchemaVersionKey], "99.0.0")
+	}
+}
+
+// TestCreateUpdateCRDv1ConcurrentCreateRace checks that createUpdateCRDv1
+// treats an IsAlreadyExists error from Create as success, since that means
+// another agent won the race to create the CRD and will also be the one to
+// update it. The fake clientset starts out empty, so the initial Get returns
+// NotFound and createUpdateCRDv1 proceeds to Create; a reactor makes that
+// Create fail with AlreadyExists to simulate the other agent winning the
+// race in between.
+func TestCreateUpdateCRDv1ConcurrentCreateRace(t *testing.T) {
+	crdName := "ciliumnetworkpolicies.cilium.io"
+	clientset := apiextensionsfake.NewSimpleClientset()
+	clientset.PrependReactor("create", "customresourcedefinitions", func(action ktesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewAlreadyExists(schema.GroupResource{Group: "apiextensions.k8s.io", Resource: "customresourcedefinitions"}, crdName)
+	})
+
+	crd := testCRD(crdName, map[string]string{
+		CustomResourceDefinitionSchemaVersionKey: CustomResourceDefinitionSchemaVersion,
+	})
+
+	if err := createUpdateCRDv1(clientset, "CiliumNetworkPolicy/v2", crd); err != nil {
+		t.Fatalf("expected createUpdateCRDv1 to treat a concurrently-created CRD as success, got: %s", err)
+	}
+}
+
+// TestHandleEstablishTimeoutV1NameConflict checks that a NamesAccepted=False
+// condition surfaces cond.Reason in the error handleEstablishTimeoutV1
+// returns, and that it never deletes a CRD it did not create itself.
+func TestHandleEstablishTimeoutV1NameConflict(t *testing.T) {
+	crdName := "ciliumnetworkpolicies.cilium.io"
+	crd := testCRD(crdName, nil)
+
+	clientset := apiextensionsfake.NewSimpleClientset(crd)
+
+	establishErr := fmt.Errorf("name conflict for CRD %s: %s", crdName, "AlreadyInUse")
+
+	// createdByUs is false here: handleEstablishTimeoutV1 must return
+	// immediately with establishErr (carrying cond.Reason from the caller)
+	// rather than attempting any delete, since it never created this CRD.
+	err := handleEstablishTimeoutV1(clientset, "CiliumNetworkPolicy/v2", crd, false, establishErr)
+	if err == nil {
+		t.Fatal("expected handleEstablishTimeoutV1 to return an error for a CRD it did not create")
+	}
+	if !strings.Contains(err.Error(), "AlreadyInUse") {
+		t.Fatalf("expected error to carry the NamesAccepted reason %q, got: %s", "AlreadyInUse", err)
+	}
+
+	_, getErr := clientset.ApiextensionsV1().CustomResourceDefinitions().Get(context.TODO(), crdName, metav1.GetOptions{})
+	if getErr != nil {
+		t.Fatalf("CRD should not have been deleted, but Get failed: %s", getErr)
+	}
+}